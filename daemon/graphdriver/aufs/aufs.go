@@ -24,12 +24,14 @@ package aufs
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -38,12 +40,14 @@ import (
 	"github.com/vbatts/tar-split/tar/storage"
 
 	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/daemon/graphdriver/quota"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/chrootarchive"
 	"github.com/docker/docker/pkg/directory"
 	"github.com/docker/docker/pkg/idtools"
 	mountpk "github.com/docker/docker/pkg/mount"
 	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/units"
 
 	"github.com/opencontainers/runc/libcontainer/label"
 )
@@ -65,14 +69,38 @@ func init() {
 	graphdriver.Register("aufs", Init)
 }
 
+// activeMount tracks the number of active references to a mounted (or
+// mountable) layer, along with the path it is mounted at. Layers are only
+// actually mounted when the reference count transitions from 0 to 1, and
+// are only unmounted when it drops back to 0, so concurrent Get/Put calls
+// for the same id (e.g. from exec and commit) can't race each other into a
+// double mount or an early unmount.
+type activeMount struct {
+	count   int
+	path    string
+	mounted bool
+}
+
 // Driver contains information about the filesystem mounted.
 type Driver struct {
 	sync.Mutex
-	root          string
-	uidMaps       []idtools.IDMap
-	gidMaps       []idtools.IDMap
-	pathCacheLock sync.Mutex
-	pathCache     map[string]string
+	root    string
+	uidMaps []idtools.IDMap
+	gidMaps []idtools.IDMap
+	active  map[string]*activeMount
+
+	quotaOnce sync.Once
+	quotaCtrl *quota.Control
+	quotaErr  error
+}
+
+// storageOpts is the per-id state persisted by setupStorageOpt so that
+// Remove and GetMetadata can find their way back to whatever quota or
+// loopback device backs a size-limited layer.
+type storageOpts struct {
+	Size       uint64 `json:"Size,omitempty"`
+	ProjectID  uint32 `json:"ProjectID,omitempty"`
+	LoopDevice string `json:"LoopDevice,omitempty"`
 }
 
 // Init returns a new AUFS driver.
@@ -105,10 +133,10 @@ func Init(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 	}
 
 	a := &Driver{
-		root:      root,
-		uidMaps:   uidMaps,
-		gidMaps:   gidMaps,
-		pathCache: make(map[string]string),
+		root:    root,
+		uidMaps: uidMaps,
+		gidMaps: gidMaps,
+		active:  make(map[string]*activeMount),
 	}
 
 	rootUID, rootGID, err := idtools.GetRootUIDGID(uidMaps, gidMaps)
@@ -180,9 +208,27 @@ func (a *Driver) Status() [][2]string {
 	}
 }
 
-// GetMetadata not implemented
+// GetMetadata returns the storage-opt usage and limit, in bytes, for
+// layers created with a size constraint. It returns nil for any other
+// layer, same as before storage-opt support existed.
 func (a *Driver) GetMetadata(id string) (map[string]string, error) {
-	return nil, nil
+	opts, err := a.loadStorageOpts(id)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Size == 0 {
+		return nil, nil
+	}
+
+	used, err := directory.Size(a.getDiffPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"LimitBytes": strconv.FormatUint(opts.Size, 10),
+		"UsageBytes": strconv.FormatUint(uint64(used), 10),
+	}, nil
 }
 
 // Exists returns true if the given id is registered with
@@ -203,9 +249,9 @@ func (a *Driver) CreateReadWrite(id, parent, mountLabel string, storageOpt map[s
 // Create three folders for each id
 // mnt, layers, and diff
 func (a *Driver) Create(id, parent, mountLabel string, storageOpt map[string]string) error {
-
-	if len(storageOpt) != 0 {
-		return fmt.Errorf("--storage-opt is not supported for aufs")
+	size, err := parseStorageOpt(storageOpt)
+	if err != nil {
+		return err
 	}
 
 	if err := a.createDirsFor(id); err != nil {
@@ -234,6 +280,203 @@ func (a *Driver) Create(id, parent, mountLabel string, storageOpt map[string]str
 		}
 	}
 
+	if size == 0 {
+		return nil
+	}
+	return a.setupStorageOpt(id, size)
+}
+
+// parseStorageOpt validates storageOpt and returns the requested size in
+// bytes, or 0 if none was given. "size" is the only option aufs knows
+// about, matching the storage-opt surface other drivers expose.
+func parseStorageOpt(storageOpt map[string]string) (uint64, error) {
+	var size uint64
+	for key, val := range storageOpt {
+		switch strings.ToLower(key) {
+		case "size":
+			sz, err := units.RAMInBytes(val)
+			if err != nil {
+				return 0, err
+			}
+			size = uint64(sz)
+		default:
+			return 0, fmt.Errorf("unknown storage option for aufs: %s", key)
+		}
+	}
+	return size, nil
+}
+
+// setupStorageOpt caps the diff directory for id at size bytes, preferring
+// an XFS project quota when the backing filesystem supports one and
+// falling back to a loopback-mounted ext4 image otherwise.
+func (a *Driver) setupStorageOpt(id string, size uint64) error {
+	diff := a.getDiffPath(id)
+
+	if backingFs == "xfs" {
+		err := a.setupQuota(id, diff, size)
+		if err == nil {
+			return nil
+		}
+		if err != quota.ErrQuotaNotSupported {
+			return err
+		}
+		logrus.Debugf("aufs: xfs project quotas unavailable on %s, falling back to a loopback image for %s", a.root, id)
+	}
+
+	return a.setupLoopback(id, diff, size)
+}
+
+func (a *Driver) setupQuota(id, diff string, size uint64) error {
+	ctrl, err := a.quotaControl()
+	if err != nil {
+		return err
+	}
+	projectID, err := ctrl.SetQuota(diff, quota.Quota{Size: size})
+	if err != nil {
+		return err
+	}
+	return a.saveStorageOpts(id, storageOpts{Size: size, ProjectID: projectID})
+}
+
+func (a *Driver) setupLoopback(id, diff string, size uint64) (err error) {
+	imageDir := path.Join(a.rootPath(), "loopback")
+	if err := idtools.MkdirAllAs(imageDir, 0700, 0, 0); err != nil {
+		return err
+	}
+	imagePath := path.Join(imageDir, id+".img")
+
+	f, err := os.Create(imagePath)
+	if err != nil {
+		return err
+	}
+	truncErr := f.Truncate(int64(size))
+	f.Close()
+	if truncErr != nil {
+		os.Remove(imagePath)
+		return truncErr
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(imagePath)
+		}
+	}()
+
+	if out, err := exec.Command("mkfs.ext4", "-F", imagePath).CombinedOutput(); err != nil {
+		return fmt.Errorf("aufs: formatting loopback image for %s: %v: %s", id, err, out)
+	}
+
+	loopDev, err := attachLoopDevice(imagePath)
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(loopDev, diff, "ext4", 0, ""); err != nil {
+		detachLoopDevice(loopDev)
+		return fmt.Errorf("aufs: mounting loopback image for %s: %v", id, err)
+	}
+
+	// mkfs.ext4 leaves the new filesystem's root inode owned by 0:0;
+	// restore the ownership createDirsFor already set on diff/<id> so
+	// user-namespace remapped daemons still get a writable diff.
+	rootUID, rootGID, err := idtools.GetRootUIDGID(a.uidMaps, a.gidMaps)
+	if err != nil {
+		Unmount(diff)
+		detachLoopDevice(loopDev)
+		return err
+	}
+	if err := os.Chown(diff, rootUID, rootGID); err != nil {
+		Unmount(diff)
+		detachLoopDevice(loopDev)
+		return fmt.Errorf("aufs: chowning loopback mount for %s: %v", id, err)
+	}
+
+	if err := a.saveStorageOpts(id, storageOpts{Size: size, LoopDevice: loopDev}); err != nil {
+		Unmount(diff)
+		detachLoopDevice(loopDev)
+		return err
+	}
+	return nil
+}
+
+func attachLoopDevice(imagePath string) (string, error) {
+	out, err := exec.Command("losetup", "-f", "--show", imagePath).Output()
+	if err != nil {
+		return "", fmt.Errorf("aufs: attaching loopback device for %s: %v", imagePath, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func detachLoopDevice(loopDev string) error {
+	return exec.Command("losetup", "-d", loopDev).Run()
+}
+
+// quotaControl lazily creates the XFS project quota controller for this
+// driver's root, since NewControl needs to probe the backing filesystem.
+func (a *Driver) quotaControl() (*quota.Control, error) {
+	a.quotaOnce.Do(func() {
+		a.quotaCtrl, a.quotaErr = quota.NewControl(a.rootPath())
+	})
+	return a.quotaCtrl, a.quotaErr
+}
+
+func (a *Driver) storageOptsPath(id string) string {
+	return path.Join(a.rootPath(), "layers", id+".json")
+}
+
+func (a *Driver) saveStorageOpts(id string, opts storageOpts) error {
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(a.storageOptsPath(id), data, 0600)
+}
+
+func (a *Driver) loadStorageOpts(id string) (storageOpts, error) {
+	var opts storageOpts
+	data, err := ioutil.ReadFile(a.storageOptsPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return opts, nil
+		}
+		return opts, err
+	}
+	err = json.Unmarshal(data, &opts)
+	return opts, err
+}
+
+// releaseStorageOpt frees any quota or loopback device set up by
+// setupStorageOpt for id and removes its persisted opts file. It is a
+// no-op for layers that were never given a size limit. The caller must
+// hold a.Mutex.
+func (a *Driver) releaseStorageOpt(id string) error {
+	opts, err := a.loadStorageOpts(id)
+	if err != nil {
+		return err
+	}
+	if opts.Size == 0 {
+		return nil
+	}
+	defer os.Remove(a.storageOptsPath(id))
+
+	if opts.ProjectID != 0 {
+		ctrl, err := a.quotaControl()
+		if err != nil {
+			return err
+		}
+		return ctrl.ClearQuota(opts.ProjectID)
+	}
+
+	if opts.LoopDevice != "" {
+		if err := Unmount(a.getDiffPath(id)); err != nil {
+			logrus.Debugf("aufs: error unmounting loopback image for %s: %v", id, err)
+		}
+		if err := detachLoopDevice(opts.LoopDevice); err != nil {
+			logrus.Debugf("aufs: error detaching loopback device %s for %s: %v", opts.LoopDevice, id, err)
+		}
+		return os.Remove(path.Join(a.rootPath(), "loopback", id+".img"))
+	}
+
 	return nil
 }
 
@@ -262,17 +505,33 @@ func (a *Driver) createDirsFor(id string) error {
 
 // Remove will unmount and remove the given id.
 func (a *Driver) Remove(id string) error {
-	a.pathCacheLock.Lock()
-	mountpoint, exists := a.pathCache[id]
-	a.pathCacheLock.Unlock()
-	if !exists {
-		mountpoint = a.getMountpoint(id)
-	}
-	if err := a.unmount(mountpoint); err != nil {
+	a.Lock()
+	defer a.Unlock()
+
+	mountpoint := a.getMountpoint(id)
+	if m, exists := a.active[id]; exists {
+		mountpoint = m.path
+		if m.count > 0 {
+			logrus.Debugf("aufs: removing layer %s with %d active references", id, m.count)
+		}
+		if m.mounted {
+			if err := Unmount(mountpoint); err != nil {
+				// no need to return here, we can still try to remove since the `Rename` will fail below if still mounted
+				logrus.Debugf("aufs: error while unmounting %s: %v", mountpoint, err)
+			}
+		}
+		delete(a.active, id)
+	} else if err := a.unmountLocked(mountpoint); err != nil {
 		// no need to return here, we can still try to remove since the `Rename` will fail below if still mounted
 		logrus.Debugf("aufs: error while unmounting %s: %v", mountpoint, err)
 	}
 
+	// The aufs union above diff/<id> must come down before we can touch a
+	// loopback mount or project quota living at diff/<id> itself.
+	if err := a.releaseStorageOpt(id); err != nil {
+		logrus.Debugf("aufs: error releasing storage-opt state for %s: %v", id, err)
+	}
+
 	// Atomically remove each directory in turn by first moving it out of the
 	// way (so that docker doesn't find it anymore) before doing removal of
 	// the whole tree.
@@ -293,59 +552,77 @@ func (a *Driver) Remove(id string) error {
 		return err
 	}
 
-	a.pathCacheLock.Lock()
-	delete(a.pathCache, id)
-	a.pathCacheLock.Unlock()
 	return nil
 }
 
 // Get returns the rootfs path for the id.
-// This will mount the dir at it's given path
+// This will mount the dir at it's given path, unless it is already mounted,
+// in which case it just bumps the active reference count.
 func (a *Driver) Get(id, mountLabel string) (string, error) {
 	parents, err := a.getParentLayerPaths(id)
 	if err != nil && !os.IsNotExist(err) {
 		return "", err
 	}
 
-	a.pathCacheLock.Lock()
-	m, exists := a.pathCache[id]
-	a.pathCacheLock.Unlock()
+	a.Lock()
+	defer a.Unlock()
 
+	m, exists := a.active[id]
 	if !exists {
-		m = a.getDiffPath(id)
+		m = &activeMount{path: a.getDiffPath(id)}
 		if len(parents) > 0 {
-			m = a.getMountpoint(id)
+			m.path = a.getMountpoint(id)
+			// A previous daemon lifetime may have left this mounted
+			// without going through Cleanup (e.g. live-restore, or a
+			// crash); adopt the existing mount instead of stacking a
+			// second union on top of it.
+			if mounted, err := a.mounted(m.path); err != nil {
+				return "", err
+			} else if mounted {
+				m.mounted = true
+			}
 		}
+		a.active[id] = m
 	}
 
-	// If a dir does not have a parent ( no layers )do not try to mount
-	// just return the diff path to the data
-	if len(parents) > 0 {
-		if err := a.mount(id, m, mountLabel, parents); err != nil {
-			return "", err
+	// If a dir does not have a parent (no layers) do not try to mount
+	// just return the diff path to the data. Otherwise only mount it the
+	// first time it becomes active; later Gets just add a reference.
+	if len(parents) > 0 && m.count == 0 && !m.mounted {
+		if err := a.aufsMount(parents, a.getDiffPath(id), m.path, mountLabel); err != nil {
+			return "", fmt.Errorf("error creating aufs mount to %s: %v", m.path, err)
 		}
+		m.mounted = true
 	}
 
-	a.pathCacheLock.Lock()
-	a.pathCache[id] = m
-	a.pathCacheLock.Unlock()
-	return m, nil
+	m.count++
+	return m.path, nil
 }
 
-// Put unmounts and updates list of active mounts.
+// Put unmounts and updates list of active mounts once their count hits 0.
 func (a *Driver) Put(id string) error {
-	a.pathCacheLock.Lock()
-	m, exists := a.pathCache[id]
+	a.Lock()
+	defer a.Unlock()
+
+	m, exists := a.active[id]
 	if !exists {
-		m = a.getMountpoint(id)
-		a.pathCache[id] = m
+		// but it might be still mounted, e.g. a restart without a prior Get
+		return a.unmountLocked(a.getMountpoint(id))
 	}
-	a.pathCacheLock.Unlock()
 
-	err := a.unmount(m)
-	if err != nil {
-		logrus.Debugf("Failed to unmount %s aufs: %v", id, err)
+	if m.count > 1 {
+		m.count--
+		return nil
 	}
+
+	var err error
+	if m.mounted {
+		err = Unmount(m.path)
+		if err != nil {
+			logrus.Debugf("Failed to unmount %s aufs: %v", id, err)
+		}
+	}
+	delete(a.active, id)
 	return err
 }
 
@@ -429,34 +706,14 @@ func (a *Driver) getParentLayerPaths(id string) ([]string, error) {
 	return layers, nil
 }
 
-func (a *Driver) mount(id string, target string, mountLabel string, layers []string) error {
-	a.Lock()
-	defer a.Unlock()
-
-	// If the id is mounted or we get an error return
-	if mounted, err := a.mounted(target); err != nil || mounted {
-		return err
-	}
-
-	rw := a.getDiffPath(id)
-
-	if err := a.aufsMount(layers, rw, target, mountLabel); err != nil {
-		return fmt.Errorf("error creating aufs mount to %s: %v", target, err)
-	}
-	return nil
-}
-
-func (a *Driver) unmount(mountPath string) error {
-	a.Lock()
-	defer a.Unlock()
-
+// unmountLocked force-unmounts mountPath if it is currently mounted
+// according to the kernel, regardless of what the active map thinks.
+// The caller must hold a.Mutex.
+func (a *Driver) unmountLocked(mountPath string) error {
 	if mounted, err := a.mounted(mountPath); err != nil || !mounted {
 		return err
 	}
-	if err := Unmount(mountPath); err != nil {
-		return err
-	}
-	return nil
+	return Unmount(mountPath)
 }
 
 func (a *Driver) mounted(mountpoint string) (bool, error) {
@@ -479,11 +736,15 @@ func (a *Driver) Cleanup() error {
 		return err
 	}
 
+	a.Lock()
 	for _, m := range dirs {
-		if err := a.unmount(m); err != nil {
+		if err := a.unmountLocked(m); err != nil {
 			logrus.Debugf("aufs error unmounting %s: %s", stringid.TruncateID(m), err)
 		}
 	}
+	a.active = make(map[string]*activeMount)
+	a.Unlock()
+
 	return mountpk.Unmount(a.root)
 }
 
@@ -0,0 +1,247 @@
+//go:build linux
+// +build linux
+
+// Package quota provides a simple interface for capping and inspecting
+// per-directory disk usage on top of the XFS project quota mechanism.
+//
+// A Control is bound to the xfs filesystem that backs a given path. Each
+// call to SetQuota hands out the next unused project id, tags the target
+// directory with it (new files created underneath inherit the tag, so the
+// whole subtree counts against the same limit) and sets a block usage cap
+// for that id. Callers are responsible for persisting the returned project
+// id if they need to look the quota up again later, e.g. to release it.
+package quota
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// ErrQuotaNotSupported is returned by NewControl when path is not backed
+// by XFS, or XFS project quotas were not enabled at mount time.
+var ErrQuotaNotSupported = fmt.Errorf("backing filesystem does not support project quotas")
+
+// Quota caps the disk usage of a directory at Size bytes. Used is only
+// populated by GetQuota; it is ignored by SetQuota.
+type Quota struct {
+	Size uint64
+	Used uint64
+}
+
+// Control manages the project ids handed out for a single XFS filesystem.
+type Control struct {
+	mu            sync.Mutex
+	backingFsDev  string
+	nextProjectID uint32
+}
+
+const xfsSuperMagic = 0x58465342
+
+// NewControl returns a Control for the xfs filesystem backing basePath.
+// basePath must already exist. ErrQuotaNotSupported is returned if the
+// filesystem isn't XFS or wasn't mounted with the pquota/prjquota option.
+func NewControl(basePath string) (*Control, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(basePath, &stat); err != nil {
+		return nil, fmt.Errorf("quota: statfs %s: %v", basePath, err)
+	}
+	if uint32(stat.Type) != xfsSuperMagic {
+		return nil, ErrQuotaNotSupported
+	}
+
+	dev, err := backingDevice(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Control{backingFsDev: dev, nextProjectID: 1}
+
+	// Make sure project quota accounting is actually turned on for this
+	// filesystem by probing project id 0, which nothing should ever use.
+	var d fsDiskQuota
+	if err := q.quotactl(qcmd(qXGetQuota, prjQuota), 0, &d); err != nil {
+		return nil, ErrQuotaNotSupported
+	}
+
+	// basePath's diff directory may already hold entries tagged with
+	// project ids from a previous daemon lifetime (this Control is
+	// recreated on every restart). Start handing out ids past the
+	// highest one already in use so we never collide with, and silently
+	// re-tag, a live layer.
+	maxID, err := maxAssignedProjectID(filepath.Join(basePath, "diff"))
+	if err != nil {
+		return nil, fmt.Errorf("quota: scanning %s for in-use project ids: %v", basePath, err)
+	}
+	if maxID >= q.nextProjectID {
+		q.nextProjectID = maxID + 1
+	}
+	return q, nil
+}
+
+// maxAssignedProjectID walks diffPath (the aufs driver's "diff" directory,
+// the only place setupQuota ever tags a project id) and returns the
+// highest project id already tagged there, or 0 if none are, or if
+// diffPath doesn't exist yet.
+func maxAssignedProjectID(diffPath string) (uint32, error) {
+	var max uint32
+	err := filepath.Walk(diffPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == diffPath {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		projectID, err := getProjectID(p)
+		if err != nil {
+			// Not every directory under diffPath is necessarily on the
+			// same filesystem, or supports the xattr at all; skip it.
+			return nil
+		}
+		if projectID > max {
+			max = projectID
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return max, nil
+}
+
+// getProjectID reads back the project id tagged on path, if any.
+func getProjectID(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var attr fsxattr
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFsgetxattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return 0, errno
+	}
+	return attr.Projid, nil
+}
+
+// SetQuota tags targetPath with a freshly allocated project id and caps
+// its block usage at quota.Size bytes. The returned id must be persisted
+// by the caller and passed back to GetQuota/ClearQuota.
+func (q *Control) SetQuota(targetPath string, quota Quota) (uint32, error) {
+	q.mu.Lock()
+	projectID := q.nextProjectID
+	q.nextProjectID++
+	q.mu.Unlock()
+
+	if err := setProjectID(targetPath, projectID); err != nil {
+		return 0, err
+	}
+
+	d := fsDiskQuota{
+		Version:      fsDqubtVersion,
+		ID:           projectID,
+		FieldMask:    fsDqBHard | fsDqBSoft,
+		BlkHardLimit: quota.Size / 512,
+		BlkSoftLimit: quota.Size / 512,
+	}
+	if err := q.quotactl(qcmd(qXSetQLim, prjQuota), projectID, &d); err != nil {
+		return 0, fmt.Errorf("quota: set quota for project %d on %s: %v", projectID, targetPath, err)
+	}
+	return projectID, nil
+}
+
+// GetQuota reads the current block usage and limit for projectID.
+func (q *Control) GetQuota(projectID uint32, quota *Quota) error {
+	var d fsDiskQuota
+	if err := q.quotactl(qcmd(qXGetQuota, prjQuota), projectID, &d); err != nil {
+		return fmt.Errorf("quota: get quota for project %d: %v", projectID, err)
+	}
+	quota.Size = d.BlkHardLimit * 512
+	quota.Used = d.BCount * 512
+	return nil
+}
+
+// ClearQuota drops projectID's limit back to zero. The id itself is not
+// reused by this Control, so it is safe to do this even if the tagged
+// directory is still on disk.
+func (q *Control) ClearQuota(projectID uint32) error {
+	d := fsDiskQuota{
+		Version:   fsDqubtVersion,
+		ID:        projectID,
+		FieldMask: fsDqBHard | fsDqBSoft,
+	}
+	return q.quotactl(qcmd(qXSetQLim, prjQuota), projectID, &d)
+}
+
+func (q *Control) quotactl(cmd int, id uint32, d *fsDiskQuota) error {
+	devPtr, err := syscall.BytePtrFromString(q.backingFsDev)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_QUOTACTL, uintptr(cmd), uintptr(unsafe.Pointer(devPtr)), uintptr(id), uintptr(unsafe.Pointer(d)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setProjectID tags path (and, via FS_XFLAG_PROJINHERIT, everything
+// created under it afterwards) with projectID using the FS_IOC_FSSETXATTR
+// ioctl.
+func setProjectID(path string, projectID uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var attr fsxattr
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFsgetxattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return fmt.Errorf("quota: get xattr flags on %s: %v", path, errno)
+	}
+	attr.Xflags |= fsXflagProjinherit
+	attr.Projid = projectID
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFssetxattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return fmt.Errorf("quota: set project id on %s: %v", path, errno)
+	}
+	return nil
+}
+
+// backingDevice returns the block device backing the filesystem mounted
+// at, or above, path by scanning /proc/mounts for the longest matching
+// mount point.
+func backingDevice(path string) (string, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var dev, best string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		source, mountpoint := fields[0], fields[1]
+		if path != mountpoint && !strings.HasPrefix(path, strings.TrimSuffix(mountpoint, "/")+"/") {
+			continue
+		}
+		if len(mountpoint) > len(best) {
+			best, dev = mountpoint, source
+		}
+	}
+	if dev == "" {
+		return "", fmt.Errorf("quota: could not find the backing device for %s", path)
+	}
+	return dev, nil
+}
@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package quota
+
+// Constants and wire structures mirroring <linux/dqblk_xfs.h> and
+// <linux/fs.h>. They are reproduced here rather than imported from cgo so
+// that this package stays a plain Go build.
+const (
+	prjQuota = 2 // PRJQUOTA
+
+	qXGetQuota = 0x5803 // Q_XGETQUOTA == XQM_CMD(3)
+	qXSetQLim  = 0x5804 // Q_XSETQLIM == XQM_CMD(4)
+
+	fsDqubtVersion = 1 // FS_DQUOT_VERSION
+
+	fsDqBSoft = 1 << 2 // FS_DQ_BSOFT
+	fsDqBHard = 1 << 3 // FS_DQ_BHARD
+
+	fsXflagProjinherit = 0x00000200 // FS_XFLAG_PROJINHERIT
+
+	fsIocFsgetxattr = 0x801c581f // FS_IOC_FSGETXATTR
+	fsIocFssetxattr = 0x401c5820 // FS_IOC_FSSETXATTR
+)
+
+// qcmd mirrors the QCMD(cmd, type) macro used to pack a quotactl command
+// and quota type into the single int the syscall expects.
+func qcmd(cmd, quotaType int) int {
+	return (cmd << 8) + quotaType
+}
+
+// fsDiskQuota mirrors struct fs_disk_quota from <linux/dqblk_xfs.h>. Every
+// field is reproduced in the kernel's order so the struct has the kernel's
+// expected size and layout, although this package only reads or writes a
+// few of them.
+type fsDiskQuota struct {
+	Version      int8
+	Flags        int8
+	FieldMask    uint16
+	ID           uint32
+	BlkHardLimit uint64
+	BlkSoftLimit uint64
+	InoHardLimit uint64
+	InoSoftLimit uint64
+	BCount       uint64
+	ICount       uint64
+	ITimer       int32
+	BTimer       int32
+	IWarns       uint16
+	BWarns       uint16
+	Padding2     int32
+	RtbHardLimit uint64
+	RtbSoftLimit uint64
+	RtbCount     uint64
+	RtbTimer     int32
+	RtbWarns     uint16
+	Padding3     int16
+	Padding4     [8]byte
+}
+
+// fsxattr mirrors struct fsxattr from <linux/fs.h>.
+type fsxattr struct {
+	Xflags     uint32
+	Extsize    uint32
+	Nextents   uint32
+	Projid     uint32
+	Cowextsize uint32
+	Pad        [8]byte
+}